@@ -3,16 +3,56 @@ package viper
 import (
 	"container/heap"
 	"context"
-	"encoding/json"
 	"fmt"
+	"math/rand"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
 )
 
+// VaultEventKind identifies what happened to a watched secret.
+type VaultEventKind int
+
+const (
+	// SecretRotated is sent whenever a watched secret's value changed,
+	// either because a KV version was bumped or a lease was reissued.
+	SecretRotated VaultEventKind = iota
+	// RenewalFailed is sent when a version poll failed; the previous
+	// value in the secret store is left untouched. A failed lease
+	// renewal is followed by a reissue instead, and reports
+	// LeaseExpired only if that reissue fails too.
+	RenewalFailed
+	// LeaseExpired is sent when a lease could neither be renewed nor
+	// reissued and is no longer being watched.
+	LeaseExpired
+	// StaleSecret is sent when a renewal or poll failed but a cached
+	// copy of the secret was still available; the secret store is
+	// refreshed from the cache and watching continues.
+	StaleSecret
+)
+
+// VaultEvent is delivered on VaultWatchConfig.Notifications whenever a
+// watched secret rotates or its renewal fails.
+type VaultEvent struct {
+	Type  VaultEventKind
+	Key   string
+	Value string
+	// Decoded is Value run through the same JSON-or-raw-string
+	// decoding GetSecret uses: a map[string]any for a whole document,
+	// the plain string for a single field that isn't itself valid JSON
+	// (a field such as "42" or "true" decodes to a number or bool).
+	// Decode it further with
+	// mapstructure.Decode into a concrete type if needed.
+	Decoded any
+	Err     error
+}
+
 // Pair of key and value
+//
+// Deprecated: kept for callers still wiring up the raw string form of
+// a secret; VaultEvent carries richer information.
 type KVEntry struct {
 	Key   string
 	Value string
@@ -20,26 +60,33 @@ type KVEntry struct {
 
 // Configuration for watching for vault's secrets.
 // Version period - how often to check for changes in secrets (0 if never)
-// AlertChannel - channel to send changes to
+// Notifications - channel typed events (SecretRotated, RenewalFailed,
+// LeaseExpired, StaleSecret) are sent to
 type VaultWatchConfig struct {
 	VersionPeriod time.Duration
-	AlertChannel  chan<- KVEntry
+	Notifications chan<- VaultEvent
+}
+
+// leaseInfo describes the lease attached to a fetched secret: how long
+// it is valid for, whether Vault will renew it in place rather than
+// issue a new one, and (for versionable engines) which KV version it
+// is.
+type leaseInfo struct {
+	id        string
+	duration  time.Duration
+	version   int
+	renewable bool
+	issuedAt  time.Time
 }
 
 type vaultClient struct {
 	client      *vault.Client
+	auth        VaultAuth
 	vaults      map[string]string
-	leases      map[string]int
+	leases      map[string]leaseInfo
 	versions    map[string]int
 	watchConfig *VaultWatchConfig
-}
-
-func isVersionable(vtype string) bool {
-	return vtype == "kv"
-}
-
-func isLeasable(vtype string) bool {
-	return vtype == "database"
+	cache       VaultCache
 }
 
 func (c *vaultClient) ConfigureVault() error {
@@ -54,39 +101,20 @@ func (c *vaultClient) ConfigureVault() error {
 			continue
 		}
 		dataMap := data.(map[string]any)
-		c.vaults[vault] = dataMap["type"].(string)
+		vtype := dataMap["type"].(string)
+		if vtype == "kv" {
+			vtype = "kv2"
+			if options, ok := dataMap["options"].(map[string]any); ok {
+				if version, ok := options["version"].(string); ok && version == "1" {
+					vtype = "kv1"
+				}
+			}
+		}
+		c.vaults[vault] = vtype
 	}
 	return nil
 }
 
-func (c *vaultClient) getKV2(mountPath string, key string, secretName string) ([]byte, int, error) {
-	data, err := c.client.Secrets.KvV2Read(context.Background(), key, vault.WithMountPath(mountPath))
-	if err != nil {
-		return nil, 0, err
-	}
-	secret, ok := data.Data.Data[secretName].(string)
-
-	if !ok {
-		return nil, 0, fmt.Errorf("Secret ( %s ) does not exist.", secretName)
-	}
-	version, err := data.Data.Metadata["version"].(json.Number).Int64()
-	if err != nil {
-		return nil, 0, err
-	}
-	return []byte(secret), int(version), nil
-}
-
-func (c *vaultClient) getDBCreds(mountPath string, role string) ([]byte, int, error) {
-	data, err := c.client.Secrets.DatabaseGenerateCredentials(context.Background(), role, vault.WithMountPath(mountPath))
-	if err != nil {
-		return nil, 0, err
-	}
-	username := data.Data["username"].(string)
-	password := data.Data["password"].(string)
-	lifetime := data.LeaseDuration
-	return []byte(username + ":" + password), lifetime, nil
-}
-
 func (c *vaultClient) getVaultTypePath(key string) (string, string, error) {
 	var vaultType, mountPath string
 	for vault, vtype := range c.vaults {
@@ -99,34 +127,62 @@ func (c *vaultClient) getVaultTypePath(key string) (string, string, error) {
 	return "", "", fmt.Errorf("Secrets engine for key ( %s ) does not exist.", key)
 }
 
-func (c *vaultClient) get(key string) ([]byte, int, error) {
+// engineFor builds the secretEngine that knows how to talk to the
+// secrets engine mounted at mountPath. Adding a new engine type only
+// requires a case here, not a change to get.
+func (c *vaultClient) engineFor(vaultType, mountPath string) (secretEngine, error) {
+	switch vaultType {
+	case "kv1":
+		return &kvV1Engine{client: c.client, mountPath: mountPath}, nil
+	case "kv2":
+		return &kvV2Engine{client: c.client, mountPath: mountPath}, nil
+	case "database":
+		return &databaseEngine{client: c.client, mountPath: mountPath}, nil
+	case "pki":
+		return &pkiEngine{client: c.client, mountPath: mountPath}, nil
+	case "transit":
+		return &transitEngine{client: c.client, mountPath: mountPath}, nil
+	case "totp":
+		return &totpEngine{client: c.client, mountPath: mountPath}, nil
+	}
+	return nil, fmt.Errorf("Vault type ( %s ) is not supported.", vaultType)
+}
+
+func (c *vaultClient) get(key string) ([]byte, leaseInfo, error) {
 	vaultType, mountPath, err := c.getVaultTypePath(key)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
 	key = strings.TrimPrefix(key, mountPath+"/")
+
+	engine, err := c.engineFor(vaultType, mountPath)
 	if err != nil {
-		return nil, 0, err
+		return nil, leaseInfo{}, err
 	}
-	switch vaultType {
-	case "kv":
-		keyWithName := strings.Split(key, ":")
-		resp, version, err := c.getKV2(mountPath, keyWithName[0], keyWithName[1])
-		if err != nil {
-			return nil, 0, err
-		}
-		if c.watchConfig != nil && c.watchConfig.VersionPeriod != 0 {
-			c.versions[mountPath+"/"+key] = version
-		}
-		return resp, version, nil
-	case "database":
-		resp, leaseTime, err := c.getDBCreds(mountPath, key)
-		if err != nil {
-			return nil, 0, err
-		}
-		if c.watchConfig != nil {
-			c.leases[mountPath+"/"+key] = leaseTime
-		}
-		return resp, leaseTime, nil
+
+	data, lease, err := engine.fetch(context.Background(), key)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	lease.issuedAt = time.Now()
+	if engine.watchable() {
+		c.trackForWatch(mountPath+"/"+key, lease)
+	}
+	return data, lease, nil
+}
+
+// trackForWatch registers path in whichever of c.leases/c.versions the
+// watch loop builds its heap from, based on the shape of lease. It is
+// a no-op when watching wasn't requested.
+func (c *vaultClient) trackForWatch(path string, lease leaseInfo) {
+	if c.watchConfig == nil {
+		return
+	}
+	if lease.duration > 0 {
+		c.leases[path] = lease
+	} else if c.watchConfig.VersionPeriod != 0 {
+		c.versions[path] = lease.version
 	}
-	return nil, 0, fmt.Errorf("Vault type ( %s ) is not supported.", vaultType)
 }
 
 func (c *vaultClient) Get(key string) ([]byte, error) {
@@ -134,115 +190,270 @@ func (c *vaultClient) Get(key string) ([]byte, error) {
 	return bts, err
 }
 
-type Watchable struct {
-	path    string
-	nextGet time.Time
+// cacheableEngine reports whether the engine serving path allows its
+// secrets to be persisted to a VaultCache, e.g. it is false for TOTP
+// codes regardless of path's lease shape.
+func (c *vaultClient) cacheableEngine(path string) bool {
+	vaultType, mountPath, err := c.getVaultTypePath(path)
+	if err != nil {
+		return false
+	}
+	engine, err := c.engineFor(vaultType, mountPath)
+	if err != nil {
+		return false
+	}
+	return engine.cacheable()
 }
 
-type watchableHeap []Watchable
+// getWithCache serves path from c.cache when it is configured, the
+// engine allows caching, and the cached lease isn't due for renewal
+// yet, falling back to a live fetch (and repopulating the cache on
+// success) otherwise.
+func (c *vaultClient) getWithCache(path string) ([]byte, leaseInfo, error) {
+	cacheable := c.cache != nil && c.cacheableEngine(path)
+	if cacheable {
+		if data, lease, err := c.cache.Load(path); err == nil && !leaseNeedsRenewal(lease) {
+			c.trackForWatch(path, lease)
+			return data, lease, nil
+		}
+	}
+	data, lease, err := c.get(path)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	if cacheable {
+		// Best-effort: a cache write failure shouldn't fail AddVault
+		// when the live fetch itself succeeded.
+		_ = c.cache.Store(path, data, lease)
+	}
+	return data, lease, nil
+}
 
-func (h watchableHeap) Len() int {
-	return len(h)
+// vaultHandle is one entry in the renewal heap: either a leased
+// secret (database creds, PKI certificates) or a versioned path (KV
+// v2, transit key) that is polled on a fixed period for version bumps.
+// The client token is renewed separately, by startTokenRenewal.
+type vaultHandle struct {
+	key        string
+	lease      leaseInfo
+	period     time.Duration
+	renewAfter time.Time
 }
 
-func (h watchableHeap) Less(i, j int) bool {
-	return h[i].nextGet.Unix() < h[j].nextGet.Unix()
+type vaultHandleHeap []*vaultHandle
+
+func (h vaultHandleHeap) Len() int { return len(h) }
+
+func (h vaultHandleHeap) Less(i, j int) bool {
+	return h[i].renewAfter.Before(h[j].renewAfter)
 }
 
-func (h watchableHeap) Swap(i, j int) {
+func (h vaultHandleHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
 }
 
-func (h *watchableHeap) Push(val any) {
-	*h = append(*h, val.(Watchable))
+func (h *vaultHandleHeap) Push(val any) {
+	*h = append(*h, val.(*vaultHandle))
 }
 
-func (h *watchableHeap) Pop() any {
-	heapDerefrenced := *h
+func (h *vaultHandleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	val := old[n-1]
+	*h = old[:n-1]
+	return val
+}
 
-	size := len(heapDerefrenced)
-	val := heapDerefrenced[size-1]
-	*h = heapDerefrenced[:size-1]
+// renewAfterWithJitter schedules a renewal at renewThreshold of
+// duration, jittered uniformly by up to 10% in either direction so
+// that replicas sharing the same leases don't renew in lockstep.
+func renewAfterWithJitter(issuedAt time.Time, duration time.Duration) time.Time {
+	base := float64(duration) * renewThreshold
+	jitter := (rand.Float64()*0.2 - 0.1) * float64(duration)
+	return issuedAt.Add(time.Duration(base + jitter))
+}
 
-	return val
+// renewOrReissue tries to renew h's lease in place via
+// sys/leases/renew and only re-fetches the secret when the lease
+// isn't renewable, has no lease ID (KV), or the renewal call fails.
+// It reports whether h should keep being watched.
+func (v *Viper) renewOrReissue(ctx context.Context, c *vaultClient, h *vaultHandle) bool {
+	if h.period != 0 {
+		oldVersion := c.versions[h.key]
+		data, lease, err := c.get(h.key)
+		if err != nil {
+			v.logger.Error("Error polling versionable vault secret on path", "path", h.key, "error", err.Error())
+			if c.serveStale(v, h.key, err) {
+				h.renewAfter = time.Now().Add(staleRetryInterval)
+				return true
+			}
+			c.watchConfig.Notifications <- VaultEvent{Type: RenewalFailed, Key: h.key, Err: err}
+			h.renewAfter = time.Now().Add(h.period)
+			return true
+		}
+		if lease.version > oldVersion {
+			v.secretstore[h.key] = string(data)
+			c.watchConfig.Notifications <- VaultEvent{Type: SecretRotated, Key: h.key, Value: string(data), Decoded: decodeSecretValue(data)}
+		}
+		if c.cache != nil {
+			_ = c.cache.Store(h.key, data, lease)
+		}
+		h.renewAfter = time.Now().Add(h.period)
+		return true
+	}
+
+	if h.lease.renewable && h.lease.id != "" {
+		resp, err := c.client.System.LeasesRenewLease(ctx, schema.LeasesRenewLeaseRequest{LeaseId: h.lease.id})
+		if err == nil && resp.Renewable {
+			h.lease.duration = time.Duration(resp.LeaseDuration) * time.Second
+			h.renewAfter = renewAfterWithJitter(time.Now(), h.lease.duration)
+			return true
+		}
+		if err != nil {
+			v.logger.Error("Error renewing vault lease on path", "path", h.key, "error", err.Error())
+		}
+	}
+
+	data, lease, err := c.get(h.key)
+	if err != nil {
+		v.logger.Error("Error reissuing leasable vault secret on path", "path", h.key, "error", err.Error())
+		if c.serveStale(v, h.key, err) {
+			h.renewAfter = time.Now().Add(staleRetryInterval)
+			return true
+		}
+		c.watchConfig.Notifications <- VaultEvent{Type: LeaseExpired, Key: h.key, Err: err}
+		return false
+	}
+	v.secretstore[h.key] = string(data)
+	c.watchConfig.Notifications <- VaultEvent{Type: SecretRotated, Key: h.key, Value: string(data), Decoded: decodeSecretValue(data)}
+	if c.cache != nil {
+		_ = c.cache.Store(h.key, data, lease)
+	}
+	h.lease = lease
+	h.renewAfter = renewAfterWithJitter(time.Now(), lease.duration)
+	return true
 }
 
-func (v *Viper) watchVault(c *vaultClient) {
-	h := watchableHeap{}
-	for path, leaseTime := range c.leases {
-		heap.Push(&h, Watchable{path: path, nextGet: time.Now().Add(time.Duration(leaseTime) * time.Second)})
+// serveStale re-serves key's last cached value into the secret store
+// and reports it as StaleSecret instead of letting a failed renewal or
+// poll tear down the watch entirely. It reports whether a cached value
+// was available.
+func (c *vaultClient) serveStale(v *Viper, key string, cause error) bool {
+	if c.cache == nil {
+		return false
+	}
+	data, _, err := c.cache.Load(key)
+	if err != nil {
+		return false
+	}
+	v.secretstore[key] = string(data)
+	c.watchConfig.Notifications <- VaultEvent{Type: StaleSecret, Key: key, Value: string(data), Decoded: decodeSecretValue(data), Err: cause}
+	return true
+}
+
+// watchVault drives both KV version polling and dynamic lease renewal
+// off a single min-heap ordered by renewAfter, so one goroutine
+// handles everything. It returns when ctx is cancelled.
+func (v *Viper) watchVault(ctx context.Context, c *vaultClient) {
+	h := &vaultHandleHeap{}
+	now := time.Now()
+	for path, lease := range c.leases {
+		heap.Push(h, &vaultHandle{key: path, lease: lease, renewAfter: renewAfterWithJitter(now, lease.duration)})
 	}
 	if c.watchConfig.VersionPeriod != 0 {
-		for path, _ := range c.versions {
-			heap.Push(&h, Watchable{path: path, nextGet: time.Now().Add(c.watchConfig.VersionPeriod)})
+		for path := range c.versions {
+			heap.Push(h, &vaultHandle{key: path, period: c.watchConfig.VersionPeriod, renewAfter: now.Add(c.watchConfig.VersionPeriod)})
 		}
 	}
-	if len(h) == 0 {
+	if h.Len() == 0 {
 		v.logger.Error("No watchable paths found for vault watching.")
-		close(c.watchConfig.AlertChannel)
+		close(c.watchConfig.Notifications)
 		return
 	}
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			if len(h) == 0 {
-				time.Sleep(time.Duration(1) * time.Second)
+
+	for {
+		if h.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
 				continue
 			}
-			event := heap.Pop(&h).(Watchable)
-			eventVaultType := c.vaults[strings.Split(event.path, "/")[0]+"/"]
-			time.Sleep(time.Until(event.nextGet))
-			if c.watchConfig.VersionPeriod != 0 && isVersionable(eventVaultType) {
-				oldVersion := c.versions[event.path]
-				data, version, err := c.get(event.path)
-				if err != nil {
-					v.logger.Error("Error watching versionable vault secret on path", event.path, err.Error())
-					return
-				}
-				if version > oldVersion {
-					v.secretstore[event.path] = string(data)
-					c.watchConfig.AlertChannel <- KVEntry{Key: event.path, Value: string(data)}
-				}
-				heap.Push(&h, Watchable{path: event.path, nextGet: time.Now().Add(c.watchConfig.VersionPeriod)})
-			} else if isLeasable(eventVaultType) {
-				data, leaseTime, err := c.get(event.path)
-				if err != nil {
-					v.logger.Error("Error watching leasable vault secret on path", event.path, err.Error())
-					return
-				}
-				v.secretstore[event.path] = string(data)
-				c.watchConfig.AlertChannel <- KVEntry{Key: event.path, Value: string(data)}
-				heap.Push(&h, Watchable{path: event.path, nextGet: time.Now().Add(time.Duration(leaseTime) * time.Second)})
-			}
 		}
-	}()
-	wg.Wait()
+
+		next := (*h)[0]
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next.renewAfter)):
+		}
+		heap.Pop(h)
+
+		if v.renewOrReissue(ctx, c, next) {
+			heap.Push(h, next)
+		}
+	}
 }
 
 // AddVault adds a vault to the viper.
-// Client should be authorized with token set.
+// Ctx controls the lifetime of the background token renewal and
+// secret watching goroutines; cancel it to stop them.
+// Auth logs the client in and is kept renewed for as long as ctx is
+// live; pass nil if client already has a token set and you are
+// managing its lifecycle yourself, or if WithWrappingToken unwraps an
+// auth lease of its own.
 // WatchConfig shoul be nil if you don't have dynamic secrets
-func (v *Viper) AddVault(client *vault.Client, watchConfig *VaultWatchConfig, paths ...string) error {
-	c := &vaultClient{client: client, watchConfig: nil}
+// Pass WithCache to serve paths from a VaultCache when possible
+// instead of always hitting Vault, and to keep watched secrets alive
+// across renewal failures.
+func (v *Viper) AddVault(ctx context.Context, client *vault.Client, auth VaultAuth, watchConfig *VaultWatchConfig, paths []string, opts ...AddVaultOption) error {
+	var options addVaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.wrappingToken != "" {
+		resp, err := UnwrapToken(ctx, client, options.wrappingToken)
+		if err != nil {
+			return fmt.Errorf("Error unwrapping vault token: %w", err)
+		}
+		if resp.Auth != nil {
+			auth = &wrappedTokenAuth{auth: resp.Auth}
+		}
+		for field, val := range resp.Data {
+			if secret, ok := val.(string); ok {
+				v.secretstore[field] = secret
+			}
+		}
+	}
+
+	c := &vaultClient{client: client, auth: auth, watchConfig: nil, cache: options.cache}
+
+	if auth != nil {
+		authResp, err := auth.Login(ctx, client)
+		if err != nil {
+			return fmt.Errorf("Error authenticating to vault: %s", err)
+		}
+		c.startTokenRenewal(ctx, v, authResp)
+	}
 
 	err := c.ConfigureVault()
 
 	if err != nil {
 		return err
 	}
+	registerVaultClient(v, c)
 
 	if watchConfig != nil {
 		c.watchConfig = watchConfig
-		c.leases = make(map[string]int)
+		c.leases = make(map[string]leaseInfo)
 		if watchConfig.VersionPeriod != 0 {
 			c.versions = make(map[string]int)
 		}
 	}
 
 	for _, path := range paths {
-		data, err := c.Get(path)
+		data, _, err := c.getWithCache(path)
 		if err != nil {
 			return fmt.Errorf("Error while adding vault: %s, path: %s", err, path)
 		}
@@ -250,9 +461,7 @@ func (v *Viper) AddVault(client *vault.Client, watchConfig *VaultWatchConfig, pa
 	}
 
 	if watchConfig != nil {
-		go func() {
-			v.watchVault(c)
-		}()
+		go v.watchVault(ctx, c)
 	}
 	return nil
 }
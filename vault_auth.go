@@ -0,0 +1,171 @@
+package viper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// renewThreshold is the fraction of a granted lease's TTL after which
+// the token renewal loop proactively renews it, rather than waiting
+// until it is about to expire.
+const renewThreshold = 0.8
+
+// defaultKubernetesJWTPath is where Kubernetes projects a pod's
+// service-account token by default.
+const defaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultAuth authenticates a vault.Client against a Vault auth method,
+// setting its token and reporting the granted lease so vaultClient can
+// keep the token alive for as long as the application runs.
+type VaultAuth interface {
+	// Login authenticates against client, calls client.SetToken with
+	// the resulting token and returns the granted auth lease.
+	Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error)
+}
+
+// UserpassAuth authenticates against the userpass auth method.
+type UserpassAuth struct {
+	Username string
+	Password string
+}
+
+func (a UserpassAuth) Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error) {
+	resp, err := client.Auth.UserpassLogin(ctx, a.Username, schema.UserpassLoginRequest{Password: a.Password})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Auth == nil {
+		return nil, fmt.Errorf("Userpass login for user ( %s ) returned no auth.", a.Username)
+	}
+	if err := client.SetToken(resp.Auth.ClientToken); err != nil {
+		return nil, err
+	}
+	return resp.Auth, nil
+}
+
+// AppRoleAuth authenticates against the approle auth method using a
+// role ID and secret ID.
+type AppRoleAuth struct {
+	RoleID   string
+	SecretID string
+}
+
+func (a AppRoleAuth) Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error) {
+	resp, err := client.Auth.AppRoleLogin(ctx, schema.AppRoleLoginRequest{RoleId: a.RoleID, SecretId: a.SecretID})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Auth == nil {
+		return nil, fmt.Errorf("AppRole login for role ( %s ) returned no auth.", a.RoleID)
+	}
+	if err := client.SetToken(resp.Auth.ClientToken); err != nil {
+		return nil, err
+	}
+	return resp.Auth, nil
+}
+
+// KubernetesAuth authenticates against the kubernetes auth method
+// using the service-account JWT Kubernetes projects into the pod.
+type KubernetesAuth struct {
+	Role string
+	// JWTPath overrides where the service-account token is read from.
+	// Defaults to the path Kubernetes projects into every pod.
+	JWTPath string
+}
+
+func (a KubernetesAuth) Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error) {
+	jwtPath := a.JWTPath
+	if jwtPath == "" {
+		jwtPath = defaultKubernetesJWTPath
+	}
+	jwt, err := os.ReadFile(jwtPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading kubernetes service account token ( %s ): %s", jwtPath, err)
+	}
+	resp, err := client.Auth.KubernetesLogin(ctx, schema.KubernetesLoginRequest{Role: a.Role, Jwt: string(jwt)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Auth == nil {
+		return nil, fmt.Errorf("Kubernetes login for role ( %s ) returned no auth.", a.Role)
+	}
+	if err := client.SetToken(resp.Auth.ClientToken); err != nil {
+		return nil, err
+	}
+	return resp.Auth, nil
+}
+
+// TokenAuth sets a pre-issued Vault token directly, without calling a
+// login endpoint. The token's own TTL is looked up so the renewal
+// loop can still keep it alive.
+type TokenAuth struct {
+	Token string
+}
+
+func (a TokenAuth) Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error) {
+	if err := client.SetToken(a.Token); err != nil {
+		return nil, err
+	}
+	resp, err := client.Auth.TokenLookUpSelf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ttl int64
+	if n, ok := resp.Data["ttl"].(json.Number); ok {
+		ttl, err = n.Int64()
+		if err != nil {
+			return nil, err
+		}
+	}
+	renewable, _ := resp.Data["renewable"].(bool)
+	return &vault.ResponseAuth{ClientToken: a.Token, LeaseDuration: int(ttl), Renewable: renewable}, nil
+}
+
+// startTokenRenewal keeps c's client token alive for as long as ctx is
+// live. It renews the token at renewThreshold of its TTL and falls
+// back to a fresh login through c.auth whenever renewal is refused or
+// fails.
+func (c *vaultClient) startTokenRenewal(ctx context.Context, v *Viper, auth *vault.ResponseAuth) {
+	go func() {
+		leaseDuration := auth.LeaseDuration
+		renewable := auth.Renewable
+		for {
+			if leaseDuration <= 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(float64(leaseDuration)*renewThreshold) * time.Second):
+			}
+
+			if renewable {
+				resp, err := c.client.Auth.TokenRenewSelf(ctx, schema.TokenRenewSelfRequest{})
+				if err == nil && resp.Auth != nil {
+					leaseDuration = resp.Auth.LeaseDuration
+					renewable = resp.Auth.Renewable
+					continue
+				}
+				reason := "renew returned no auth"
+				if err != nil {
+					reason = err.Error()
+				}
+				v.logger.Error("Error renewing vault token, re-authenticating", "error", reason)
+			}
+
+			newAuth, err := c.auth.Login(ctx, c.client)
+			if err != nil {
+				v.logger.Error("Error re-authenticating to vault", "error", err.Error())
+				return
+			}
+			leaseDuration = newAuth.LeaseDuration
+			renewable = newAuth.Renewable
+		}
+	}()
+}
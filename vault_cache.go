@@ -0,0 +1,188 @@
+package viper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// VaultCache persists fetched secrets across restarts so an application
+// can still start, serving the last known-good value, when Vault is
+// unreachable or sealed. Implementations are expected to be safe for
+// concurrent use.
+type VaultCache interface {
+	// Load returns the secret last stored under key, or an error if
+	// none is cached or it fails its integrity check.
+	Load(key string) ([]byte, leaseInfo, error)
+	// Store persists value and its lease under key, overwriting
+	// whatever was previously cached.
+	Store(key string, value []byte, lease leaseInfo) error
+	// Delete removes whatever is cached under key, if anything.
+	Delete(key string) error
+}
+
+// staleRetryInterval is how often the watch loop retries Vault for a
+// handle that is currently being served stale from cache.
+const staleRetryInterval = 30 * time.Second
+
+// cacheEntry is the JSON payload FileVaultCache signs and stores.
+type cacheEntry struct {
+	Value     []byte        `json:"value"`
+	LeaseID   string        `json:"lease_id,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Version   int           `json:"version"`
+	Renewable bool          `json:"renewable"`
+	IssuedAt  time.Time     `json:"issued_at"`
+}
+
+// cacheFile wraps a cacheEntry with an HMAC-SHA256 tag over its JSON
+// encoding, so a cache file tampered with on disk is rejected on load
+// rather than silently trusted.
+type cacheFile struct {
+	Entry cacheEntry `json:"entry"`
+	HMAC  string     `json:"hmac"`
+}
+
+// FileVaultCache is the default VaultCache: one JSON file per secret
+// under a directory, named by the hash of its key so the on-disk
+// layout doesn't leak secret paths, and signed with an HMAC keyed by
+// either a caller-supplied passphrase or a machine-bound key.
+type FileVaultCache struct {
+	dir        string
+	passphrase []byte
+}
+
+// NewFileVaultCache opens (creating if needed) a file-backed cache
+// under $XDG_STATE_HOME/viper/vault, falling back to
+// ~/.local/state/viper/vault. If passphrase is nil, entries are signed
+// with a key derived from /etc/machine-id, which ties the cache to the
+// host it was written on.
+func NewFileVaultCache(passphrase []byte) (*FileVaultCache, error) {
+	dir, err := vaultCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("Error creating vault cache directory ( %s ): %s", dir, err)
+	}
+	if passphrase == nil {
+		passphrase, err = machineBoundKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FileVaultCache{dir: dir, passphrase: passphrase}, nil
+}
+
+func vaultCacheDir() (string, error) {
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("Error locating home directory for vault cache: %s", err)
+		}
+		base = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(base, "viper", "vault"), nil
+}
+
+// machineBoundKey derives a signing key from /etc/machine-id, so a
+// cache file copied to another host fails its integrity check.
+func machineBoundKey() ([]byte, error) {
+	id, err := os.ReadFile("/etc/machine-id")
+	if err != nil {
+		return nil, fmt.Errorf("Error deriving machine-bound vault cache key: %s", err)
+	}
+	sum := sha256.Sum256(id)
+	return sum[:], nil
+}
+
+func (c *FileVaultCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *FileVaultCache) sign(entry cacheEntry) (string, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, c.passphrase)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (c *FileVaultCache) Load(key string) ([]byte, leaseInfo, error) {
+	raw, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	var file cacheFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, leaseInfo{}, fmt.Errorf("Cache entry for key ( %s ) is corrupt: %s", key, err)
+	}
+	expected, err := c.sign(file.Entry)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(file.HMAC)) {
+		return nil, leaseInfo{}, fmt.Errorf("Cache entry for key ( %s ) failed its integrity check.", key)
+	}
+	lease := leaseInfo{
+		id:        file.Entry.LeaseID,
+		duration:  file.Entry.Duration,
+		version:   file.Entry.Version,
+		renewable: file.Entry.Renewable,
+		issuedAt:  file.Entry.IssuedAt,
+	}
+	return file.Entry.Value, lease, nil
+}
+
+func (c *FileVaultCache) Store(key string, value []byte, lease leaseInfo) error {
+	entry := cacheEntry{
+		Value:     value,
+		LeaseID:   lease.id,
+		Duration:  lease.duration,
+		Version:   lease.version,
+		Renewable: lease.renewable,
+		IssuedAt:  lease.issuedAt,
+	}
+	tag, err := c.sign(entry)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(cacheFile{Entry: entry, HMAC: tag})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path(key), raw, 0o600); err != nil {
+		return fmt.Errorf("Error writing vault cache entry for key ( %s ): %s", key, err)
+	}
+	return nil
+}
+
+func (c *FileVaultCache) Delete(key string) error {
+	err := os.Remove(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// leaseNeedsRenewal reports whether a cached lease has already crossed
+// its renewal window (renewThreshold of its duration since issuedAt)
+// and should be refreshed from Vault instead of trusted as-is. A lease
+// with no duration at all (KV and other static secrets) never expires,
+// so it is never considered stale by age and reports false.
+func leaseNeedsRenewal(lease leaseInfo) bool {
+	if lease.duration <= 0 {
+		return false
+	}
+	return !time.Now().Before(lease.issuedAt.Add(time.Duration(float64(lease.duration) * renewThreshold)))
+}
@@ -0,0 +1,67 @@
+package viper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// decodeSecretValue turns a fetched secret's raw bytes into the value
+// GetSecret and VaultEvent.Decoded hand callers: a map[string]any when
+// an engine returned a whole JSON document (a bare "path" key), or the
+// plain string when it returned a single field (a "path:field" key)
+// that isn't itself valid JSON. Any raw value that parses as JSON is
+// returned decoded, so a field such as "42" becomes a float64.
+func decodeSecretValue(raw []byte) any {
+	var data any
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return string(raw)
+	}
+	return data
+}
+
+// vaultDecodeHook lets GetSecret decode Vault's string-typed fields
+// into Go types that aren't themselves strings: a duration string
+// ("1h30m") into time.Duration, and a base64-encoded field into
+// []byte.
+func vaultDecodeHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String {
+		return data, nil
+	}
+	switch to {
+	case reflect.TypeOf(time.Duration(0)):
+		return time.ParseDuration(data.(string))
+	case reflect.TypeOf([]byte(nil)):
+		return base64.StdEncoding.DecodeString(data.(string))
+	}
+	return data, nil
+}
+
+// GetSecret decodes the secret stored at key into out via mapstructure,
+// instead of handing back the stringified form Get does. A bare path
+// (no ":field" suffix) decodes the whole document most engines store
+// as JSON (every field of a KV v2 entry, every credential in a
+// generated database role); a "path:field" key decodes just the
+// addressed field, the same addressing Get uses.
+func (v *Viper) GetSecret(key string, out any) error {
+	raw, ok := v.secretstore[key]
+	if !ok {
+		return fmt.Errorf("Secret ( %s ) does not exist.", key)
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: vaultDecodeHook,
+		Result:     out,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(decodeSecretValue([]byte(raw))); err != nil {
+		return fmt.Errorf("Error decoding secret ( %s ): %s", key, err)
+	}
+	return nil
+}
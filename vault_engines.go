@@ -0,0 +1,413 @@
+package viper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// secretEngine is satisfied by every supported Vault secrets engine.
+// It lets vaultClient.get dispatch by mount type without a growing
+// switch statement: adding support for a new engine only means adding
+// a type here and a case in vaultClient.engineFor.
+type secretEngine interface {
+	// fetch reads path, however the engine interprets it, and returns
+	// its current value along with the lease/version that governs how
+	// long it stays valid.
+	fetch(ctx context.Context, path string) ([]byte, leaseInfo, error)
+	// watchable reports whether this engine's secrets can be renewed
+	// or polled by the watch loop.
+	watchable() bool
+	// cacheable reports whether this engine's secrets are safe to
+	// persist to a VaultCache across restarts. Engines whose value is
+	// short-lived by design regardless of any lease, like TOTP codes,
+	// must say no.
+	cacheable() bool
+}
+
+func splitKeyAndField(key string) (string, string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Key ( %s ) is missing a field name.", key)
+	}
+	return parts[0], parts[1], nil
+}
+
+// splitKeyAndOptionalField is splitKeyAndField for engines where the
+// field is optional: a bare "path" (no colon) addresses the whole
+// document, the same way "path:field" addresses one field of it.
+func splitKeyAndOptionalField(key string) (path string, field string) {
+	path, field, _ = strings.Cut(key, ":")
+	return path, field
+}
+
+// kvV1Engine reads secrets from a version 1 (unversioned) KV mount.
+type kvV1Engine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *kvV1Engine) fetch(ctx context.Context, key string) ([]byte, leaseInfo, error) {
+	path, field := splitKeyAndOptionalField(key)
+	resp, err := e.client.Secrets.KvV1Read(ctx, path, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	if field == "" {
+		payload, err := json.Marshal(resp.Data)
+		if err != nil {
+			return nil, leaseInfo{}, err
+		}
+		return payload, leaseInfo{}, nil
+	}
+	secret, ok := resp.Data[field].(string)
+	if !ok {
+		return nil, leaseInfo{}, fmt.Errorf("Secret ( %s ) does not exist.", field)
+	}
+	return []byte(secret), leaseInfo{}, nil
+}
+
+func (e *kvV1Engine) watchable() bool { return false }
+
+func (e *kvV1Engine) cacheable() bool { return true }
+
+// kvV2Engine reads secrets from a version 2 (versioned) KV mount.
+type kvV2Engine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *kvV2Engine) fetch(ctx context.Context, key string) ([]byte, leaseInfo, error) {
+	path, field := splitKeyAndOptionalField(key)
+	data, err := e.client.Secrets.KvV2Read(ctx, path, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	version, err := data.Data.Metadata["version"].(json.Number).Int64()
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	lease := leaseInfo{version: int(version)}
+	if field == "" {
+		payload, err := json.Marshal(data.Data.Data)
+		if err != nil {
+			return nil, leaseInfo{}, err
+		}
+		return payload, lease, nil
+	}
+	secret, ok := data.Data.Data[field].(string)
+	if !ok {
+		return nil, leaseInfo{}, fmt.Errorf("Secret ( %s ) does not exist.", field)
+	}
+	return []byte(secret), lease, nil
+}
+
+func (e *kvV2Engine) watchable() bool { return true }
+
+func (e *kvV2Engine) cacheable() bool { return true }
+
+// databaseEngine generates dynamic database credentials.
+type databaseEngine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *databaseEngine) fetch(ctx context.Context, role string) ([]byte, leaseInfo, error) {
+	data, err := e.client.Secrets.DatabaseGenerateCredentials(ctx, role, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	payload, err := json.Marshal(data.Data)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	lease := leaseInfo{
+		id:        data.LeaseID,
+		duration:  time.Duration(data.LeaseDuration) * time.Second,
+		renewable: data.Renewable,
+	}
+	return payload, lease, nil
+}
+
+func (e *databaseEngine) watchable() bool { return true }
+
+func (e *databaseEngine) cacheable() bool { return true }
+
+// VaultCertificate is the PEM certificate, private key and issuing CA
+// chain returned by a PKI engine issue call.
+type VaultCertificate struct {
+	Certificate string   `json:"certificate"`
+	PrivateKey  string   `json:"private_key"`
+	CAChain     []string `json:"ca_chain"`
+}
+
+// VaultPKIRequest configures an issued certificate's subject, SANs and
+// TTL. Zero-valued fields fall back to the role's configured defaults.
+type VaultPKIRequest struct {
+	CommonName string
+	AltNames   []string
+	TTL        time.Duration
+}
+
+// pkiEngine issues certificates against a PKI mount. Keys take the
+// form "<role>:<commonName>", mirroring the "<path>:<field>" syntax
+// used by the KV engines.
+type pkiEngine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *pkiEngine) fetch(ctx context.Context, key string) ([]byte, leaseInfo, error) {
+	role, commonName, err := splitKeyAndField(key)
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	return e.issue(ctx, role, VaultPKIRequest{CommonName: commonName})
+}
+
+func (e *pkiEngine) issue(ctx context.Context, role string, req VaultPKIRequest) ([]byte, leaseInfo, error) {
+	ttl := ""
+	if req.TTL > 0 {
+		ttl = req.TTL.String()
+	}
+	resp, err := e.client.Secrets.PkiIssueWithRole(ctx, role, schema.PkiIssueWithRoleRequest{
+		CommonName: req.CommonName,
+		AltNames:   strings.Join(req.AltNames, ","),
+		Ttl:        ttl,
+	}, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	payload, err := json.Marshal(VaultCertificate{
+		Certificate: resp.Data.Certificate,
+		PrivateKey:  resp.Data.PrivateKey,
+		CAChain:     resp.Data.CaChain,
+	})
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	lease := leaseInfo{duration: time.Until(time.Unix(resp.Data.Expiration, 0))}
+	return payload, lease, nil
+}
+
+func (e *pkiEngine) watchable() bool { return true }
+
+func (e *pkiEngine) cacheable() bool { return true }
+
+// transitEngine encrypts, decrypts and signs data with a transit key,
+// and tracks the key's latest version so watchVault can alert when it
+// is rotated.
+type transitEngine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *transitEngine) fetch(ctx context.Context, key string) ([]byte, leaseInfo, error) {
+	resp, err := e.client.Secrets.TransitReadKey(ctx, key, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	version, ok := resp.Data["latest_version"].(json.Number)
+	if !ok {
+		return nil, leaseInfo{}, fmt.Errorf("Transit key ( %s ) response is missing latest_version.", key)
+	}
+	latest, err := version.Int64()
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	return []byte(key), leaseInfo{version: int(latest)}, nil
+}
+
+func (e *transitEngine) watchable() bool { return true }
+
+func (e *transitEngine) cacheable() bool { return true }
+
+func (e *transitEngine) Encrypt(ctx context.Context, key string, plaintext []byte) (string, error) {
+	resp, err := e.client.Secrets.TransitEncrypt(ctx, key, schema.TransitEncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, ok := resp.Data["ciphertext"].(string)
+	if !ok {
+		return "", fmt.Errorf("Transit encrypt response for key ( %s ) is missing ciphertext.", key)
+	}
+	return ciphertext, nil
+}
+
+func (e *transitEngine) Decrypt(ctx context.Context, key string, ciphertext string) ([]byte, error) {
+	resp, err := e.client.Secrets.TransitDecrypt(ctx, key, schema.TransitDecryptRequest{
+		Ciphertext: ciphertext,
+	}, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := resp.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Transit decrypt response for key ( %s ) is missing plaintext.", key)
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func (e *transitEngine) Sign(ctx context.Context, key string, input []byte) (string, error) {
+	resp, err := e.client.Secrets.TransitSign(ctx, key, schema.TransitSignRequest{
+		Input: base64.StdEncoding.EncodeToString(input),
+	}, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return "", err
+	}
+	signature, ok := resp.Data["signature"].(string)
+	if !ok {
+		return "", fmt.Errorf("Transit sign response for key ( %s ) is missing signature.", key)
+	}
+	return signature, nil
+}
+
+// totpEngine fetches a TOTP code on demand. Codes are never cached:
+// they are short-lived by design and a stale code is useless.
+type totpEngine struct {
+	client    *vault.Client
+	mountPath string
+}
+
+func (e *totpEngine) fetch(ctx context.Context, key string) ([]byte, leaseInfo, error) {
+	resp, err := e.client.Secrets.TotpGenerateCode(ctx, key, vault.WithMountPath(e.mountPath))
+	if err != nil {
+		return nil, leaseInfo{}, err
+	}
+	code, ok := resp.Data["code"].(string)
+	if !ok {
+		return nil, leaseInfo{}, fmt.Errorf("TOTP key ( %s ) response is missing code.", key)
+	}
+	return []byte(code), leaseInfo{}, nil
+}
+
+func (e *totpEngine) watchable() bool { return false }
+
+// cacheable is false: a TOTP code is only valid for a short, fixed
+// window, so persisting it would just serve a stale, useless code on
+// the next restart.
+func (e *totpEngine) cacheable() bool { return false }
+
+// vaultClientsByViper tracks every vaultClient a Viper's AddVault
+// calls have built, keyed by the Viper itself rather than a field on
+// it, since the core Viper struct lives outside this package and
+// can't grow one. It backs the exported Transit*/IssuePKI methods,
+// which need to reach a live vaultClient for a mount added at some
+// earlier AddVault call instead of just reading the flattened secret
+// store. Entries are reclaimed via a finalizer on v rather than an
+// explicit deregister call, since nothing else in the API has a
+// natural "I'm done with this Viper" hook.
+var (
+	vaultClientsMu      sync.Mutex
+	vaultClientsByViper = map[*Viper][]*vaultClient{}
+)
+
+func registerVaultClient(v *Viper, c *vaultClient) {
+	vaultClientsMu.Lock()
+	defer vaultClientsMu.Unlock()
+	if _, tracked := vaultClientsByViper[v]; !tracked {
+		runtime.SetFinalizer(v, deregisterVaultClient)
+	}
+	vaultClientsByViper[v] = append(vaultClientsByViper[v], c)
+}
+
+func deregisterVaultClient(v *Viper) {
+	vaultClientsMu.Lock()
+	defer vaultClientsMu.Unlock()
+	delete(vaultClientsByViper, v)
+}
+
+// engineForKey finds the secretEngine of type vaultType serving key's
+// mount among the vaultClients v.AddVault has built, and returns it
+// along with key trimmed down to the bare name that engine expects.
+func (v *Viper) engineForKey(key string, vaultType string) (secretEngine, string, error) {
+	vaultClientsMu.Lock()
+	clients := append([]*vaultClient(nil), vaultClientsByViper[v]...)
+	vaultClientsMu.Unlock()
+
+	for _, c := range clients {
+		gotType, mountPath, err := c.getVaultTypePath(key)
+		if err != nil || gotType != vaultType {
+			continue
+		}
+		engine, err := c.engineFor(gotType, mountPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return engine, strings.TrimPrefix(key, mountPath+"/"), nil
+	}
+	return nil, "", fmt.Errorf("No vault with a %s mount for key ( %s ) was added.", vaultType, key)
+}
+
+func (v *Viper) transitEngineFor(key string) (*transitEngine, string, error) {
+	engine, trimmed, err := v.engineForKey(key, "transit")
+	if err != nil {
+		return nil, "", err
+	}
+	return engine.(*transitEngine), trimmed, nil
+}
+
+// TransitEncrypt encrypts plaintext with the transit key named by key
+// (the mount path and key name, as added via AddVault).
+func (v *Viper) TransitEncrypt(key string, plaintext []byte) (string, error) {
+	engine, transitKey, err := v.transitEngineFor(key)
+	if err != nil {
+		return "", err
+	}
+	return engine.Encrypt(context.Background(), transitKey, plaintext)
+}
+
+// TransitDecrypt decrypts ciphertext previously produced by
+// TransitEncrypt (or Vault's own transit/encrypt endpoint) with the
+// transit key named by key.
+func (v *Viper) TransitDecrypt(key string, ciphertext string) ([]byte, error) {
+	engine, transitKey, err := v.transitEngineFor(key)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Decrypt(context.Background(), transitKey, ciphertext)
+}
+
+// TransitSign signs input with the transit key named by key.
+func (v *Viper) TransitSign(key string, input []byte) (string, error) {
+	engine, transitKey, err := v.transitEngineFor(key)
+	if err != nil {
+		return "", err
+	}
+	return engine.Sign(context.Background(), transitKey, input)
+}
+
+// IssuePKI issues a certificate from the PKI mount and role named by
+// key (e.g. "pki/role-name"), with req controlling the subject, SANs
+// and TTL. Unlike Get's "role:commonName" addressing, which only
+// exposes CommonName, this is the entry point for the rest of
+// VaultPKIRequest.
+func (v *Viper) IssuePKI(key string, req VaultPKIRequest) (*VaultCertificate, error) {
+	engine, trimmed, err := v.engineForKey(key, "pki")
+	if err != nil {
+		return nil, err
+	}
+	pe, ok := engine.(*pkiEngine)
+	if !ok {
+		return nil, fmt.Errorf("Vault mount for key ( %s ) is not a pki engine.", key)
+	}
+	payload, _, err := pe.issue(context.Background(), trimmed, req)
+	if err != nil {
+		return nil, err
+	}
+	var cert VaultCertificate
+	if err := json.Unmarshal(payload, &cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
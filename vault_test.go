@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/hashicorp/vault-client-go"
-	"github.com/hashicorp/vault-client-go/schema"
 )
 
 func TestVault(t *testing.T) {
@@ -20,19 +19,37 @@ func TestVault(t *testing.T) {
 		t.Error(err)
 		t.FailNow()
 	}
-	resp, err := vClient.Auth.UserpassLogin(context.Background(), login, schema.UserpassLoginRequest{
-		Password: password,
-	})
+	auth := UserpassAuth{Username: login, Password: password}
+	err = v.AddVault(context.Background(), vClient, auth, nil, []string{"sample/secret:sample"})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
-	err = vClient.SetToken(resp.Auth.ClientToken)
+	if val := v.Get("sample/secret:sample"); val != "text" {
+		t.Error(fmt.Errorf("sample-value is %s, expected: text", val))
+		t.FailNow()
+	}
+}
+
+func TestVaultListen(t *testing.T) {
+	address := "http://192.168.80.3:8200"
+	login := "dunkelheit"
+	password := "dunkelheit"
+	vClient, err := vault.New(vault.WithAddress(address))
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
-	err = v.AddVault(vClient, nil, "sample/secret:sample")
+	auth := UserpassAuth{Username: login, Password: password}
+
+	eventChan := make(chan VaultEvent)
+
+	vaultWatchConf := VaultWatchConfig{
+		VersionPeriod: time.Second * 0,
+		Notifications: eventChan,
+	}
+
+	err = v.AddVault(context.Background(), vClient, auth, &vaultWatchConf, []string{"sample/secret:sample"})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -41,9 +58,13 @@ func TestVault(t *testing.T) {
 		t.Error(fmt.Errorf("sample-value is %s, expected: text", val))
 		t.FailNow()
 	}
+
+	event := <-eventChan
+	fmt.Printf("%s %s\n", event.Key, event.Value)
 }
 
-func TestVaultListen(t *testing.T) {
+func TestVaultCache(t *testing.T) {
+	v = New()
 	address := "http://192.168.80.3:8200"
 	login := "dunkelheit"
 	password := "dunkelheit"
@@ -52,27 +73,132 @@ func TestVaultListen(t *testing.T) {
 		t.Error(err)
 		t.FailNow()
 	}
-	resp, err := vClient.Auth.UserpassLogin(context.Background(), login, schema.UserpassLoginRequest{
-		Password: password,
-	})
+	auth := UserpassAuth{Username: login, Password: password}
+	cache, err := NewFileVaultCache([]byte("test-passphrase"))
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
-	err = vClient.SetToken(resp.Auth.ClientToken)
+	err = v.AddVault(context.Background(), vClient, auth, nil, []string{"sample/secret:sample"}, WithCache(cache))
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
+	if val := v.Get("sample/secret:sample"); val != "text" {
+		t.Error(fmt.Errorf("sample-value is %s, expected: text", val))
+		t.FailNow()
+	}
+	if _, _, err := cache.Load("sample/secret:sample"); err != nil {
+		t.Error(fmt.Errorf("expected secret to be cached after AddVault: %s", err))
+		t.FailNow()
+	}
+}
 
-	eventChan := make(chan KVEntry)
+func TestVaultTransit(t *testing.T) {
+	v = New()
+	address := "http://192.168.80.3:8200"
+	login := "dunkelheit"
+	password := "dunkelheit"
+	vClient, err := vault.New(vault.WithAddress(address))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	auth := UserpassAuth{Username: login, Password: password}
+	err = v.AddVault(context.Background(), vClient, auth, nil, []string{"transit/sample-key"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
 
-	vaultWatchConf := VaultWatchConfig{
-		VersionPeriod: time.Second * 0,
-		AlertChannel:  eventChan,
+	ciphertext, err := v.TransitEncrypt("transit/sample-key", []byte("plaintext"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
 	}
+	plaintext, err := v.TransitDecrypt("transit/sample-key", ciphertext)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if string(plaintext) != "plaintext" {
+		t.Error(fmt.Errorf("decrypted value is %s, expected: plaintext", plaintext))
+		t.FailNow()
+	}
+}
 
-	err = v.AddVault(vClient, &vaultWatchConf, "sample/secret:sample")
+func TestVaultIssuePKI(t *testing.T) {
+	v = New()
+	address := "http://192.168.80.3:8200"
+	login := "dunkelheit"
+	password := "dunkelheit"
+	vClient, err := vault.New(vault.WithAddress(address))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	auth := UserpassAuth{Username: login, Password: password}
+	err = v.AddVault(context.Background(), vClient, auth, nil, []string{"pki/sample-role:sample.example.com"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	cert, err := v.IssuePKI("pki/sample-role", VaultPKIRequest{
+		CommonName: "sample.example.com",
+		AltNames:   []string{"alt.example.com"},
+		TTL:        time.Hour,
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if cert.Certificate == "" {
+		t.Error(fmt.Errorf("expected a non-empty certificate"))
+		t.FailNow()
+	}
+}
+
+func TestVaultGetSecret(t *testing.T) {
+	v = New()
+	address := "http://192.168.80.3:8200"
+	login := "dunkelheit"
+	password := "dunkelheit"
+	vClient, err := vault.New(vault.WithAddress(address))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	auth := UserpassAuth{Username: login, Password: password}
+	err = v.AddVault(context.Background(), vClient, auth, nil, []string{"sample/secret"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var doc struct {
+		Sample string `mapstructure:"sample"`
+	}
+	if err := v.GetSecret("sample/secret", &doc); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if doc.Sample != "text" {
+		t.Error(fmt.Errorf("sample-value is %s, expected: text", doc.Sample))
+		t.FailNow()
+	}
+}
+
+func TestVaultWrappingToken(t *testing.T) {
+	v = New()
+	address := "http://192.168.80.3:8200"
+	wrappingToken := "s.wrappedtoken"
+	vClient, err := vault.New(vault.WithAddress(address))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = v.AddVault(context.Background(), vClient, nil, nil, []string{"sample/secret:sample"}, WithWrappingToken(wrappingToken))
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -81,7 +207,4 @@ func TestVaultListen(t *testing.T) {
 		t.Error(fmt.Errorf("sample-value is %s, expected: text", val))
 		t.FailNow()
 	}
-
-	event := <-eventChan
-	fmt.Printf("%s %s\n", event.Key, event.Value)
 }
@@ -0,0 +1,89 @@
+package viper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// AddVaultOption configures optional, less commonly needed behavior
+// on AddVault.
+type AddVaultOption func(*addVaultOptions)
+
+type addVaultOptions struct {
+	wrappingToken string
+	cache         VaultCache
+}
+
+// WithWrappingToken makes AddVault unwrap a single-use cubbyhole
+// wrapping token before doing anything else. If the wrapped response
+// carries an auth lease it is used in place of auth; if it carries
+// secret data, that data is seeded into the secret store directly,
+// keyed by field name.
+func WithWrappingToken(token string) AddVaultOption {
+	return func(o *addVaultOptions) { o.wrappingToken = token }
+}
+
+// WithCache makes AddVault and the watch loop it starts read through
+// cache: paths are served from it when their cached lease isn't due
+// for renewal, and a failed renewal or poll re-serves the last cached
+// value (as a StaleSecret event) instead of giving up on that path.
+func WithCache(cache VaultCache) AddVaultOption {
+	return func(o *addVaultOptions) { o.cache = cache }
+}
+
+// ErrVaultUnrecoverable marks unwrap failures that will not succeed on
+// retry (an already-used or invalid wrapping token, or a response
+// missing both an auth lease and secret data). Callers can use
+// errors.Is to decide whether retrying AddVault is worthwhile.
+var ErrVaultUnrecoverable = errors.New("vault: wrapping token cannot be unwrapped")
+
+// UnwrapToken exchanges a single-use cubbyhole wrapping token,
+// typically delivered out-of-band by an orchestrator, for the secret
+// or auth lease it wraps. It is the building block WithWrappingToken
+// uses, and is exported so applications that need to unwrap a token
+// outside of AddVault don't have to reimplement it.
+func UnwrapToken(ctx context.Context, client *vault.Client, wrappingToken string) (*vault.Response[map[string]any], error) {
+	resp, err := client.System.Unwrap(ctx, schema.UnwrapRequest{}, vault.WithToken(wrappingToken))
+	if err != nil {
+		if vault.IsErrorStatus(err, 400) || vault.IsErrorStatus(err, 403) {
+			return nil, fmt.Errorf("vault: wrapping token rejected: %s: %w", err, ErrVaultUnrecoverable)
+		}
+		return nil, err
+	}
+	if resp.Auth == nil && resp.Data == nil {
+		return nil, fmt.Errorf("vault: unwrap response carried neither an auth lease nor secret data: %w", ErrVaultUnrecoverable)
+	}
+	return resp, nil
+}
+
+// wrappedTokenAuth seeds a vault.Client's token from the auth lease
+// delivered by a response-wrapped login, without calling a login
+// endpoint of its own. The lease it hands out was single-use to begin
+// with, so Login only honors it once; startTokenRenewal falls back to
+// Login again when renewal fails, and re-installing the same already
+// consumed token would otherwise make that fallback succeed forever
+// with a dead token instead of giving up.
+type wrappedTokenAuth struct {
+	auth *vault.ResponseAuth
+
+	mu   sync.Mutex
+	used bool
+}
+
+func (a *wrappedTokenAuth) Login(ctx context.Context, client *vault.Client) (*vault.ResponseAuth, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.used {
+		return nil, fmt.Errorf("vault: wrapped auth lease was single-use and has already been consumed")
+	}
+	a.used = true
+	if err := client.SetToken(a.auth.ClientToken); err != nil {
+		return nil, err
+	}
+	return a.auth, nil
+}